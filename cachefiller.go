@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/MiLk/nsscache-go/cache"
 	"github.com/MiLk/nsscache-go/source"
 	"github.com/hashicorp/go-hclog"
 
-	pb "github.com/netauth/protocol"
 	"github.com/netauth/netauth/pkg/netauth"
+	pb "github.com/netauth/protocol"
 
 	// We need a token cache available, even if no tokens will be
 	// issued.
@@ -24,6 +26,31 @@ type NetAuthCacheFiller struct {
 	members  map[string][]string
 	pgroups  map[string]uint32
 
+	// groupMeta holds the arbitrary key/value metadata attached to
+	// each group via NetAuth's KV store, keyed by group name.  It
+	// drives the netgroup/automount/sudoers projections below, and
+	// is populated on a best-effort basis: a group with no KV data
+	// (or a server that errors on the lookup) simply doesn't
+	// participate in those maps.
+	groupMeta map[string]map[string]string
+
+	// entityMeta holds the arbitrary key/value metadata attached to
+	// each entity via NetAuth's KV store, keyed by entity ID.  Used
+	// by the HostTag access check below to read AllowedHosts.
+	entityMeta map[string]map[string]string
+
+	// unauthorized holds the IDs of entities that failed the
+	// HostTag access check.  It's only populated when HostTag and
+	// AuditUnauthorized are both set, and is consulted by
+	// PasswdEntries to force an unauthorized entity's shell to
+	// nologin instead of omitting it outright.
+	unauthorized map[string]bool
+
+	// groupsSkippedMinGID counts groups discarded by findGroups for
+	// having a GID below MinGID, surfaced as a metric in daemon
+	// mode.
+	groupsSkippedMinGID int
+
 	// The MinUID and MinGID specify the numeric lower bound for
 	// remote values to be loaded into the system.  These values
 	// should be set with a decent amount of headroom above the
@@ -51,19 +78,129 @@ type NetAuthCacheFiller struct {
 	// during templating if no other home directory is specified.
 	DefaultHome string
 
+	// Incremental controls whether this filler compares every
+	// loaded entity/group against the content hashes stored in
+	// StatePath to detect what changed since the last run.  Every
+	// entity/group is still loaded and re-templated either way;
+	// the comparison doesn't change what ends up in the rendered
+	// caches, but it lets callers skip a rewrite entirely when
+	// nothing has changed.
+	Incremental bool
+
+	// StatePath is where the per-entity/per-group content hashes
+	// from the last run are persisted.  It is only consulted when
+	// Incremental is true.
+	StatePath string
+
+	// changes holds the result of the last call to
+	// DetectChanges, for callers that want to log or act on it.
+	changes ChangeSummary
+
+	// nextState holds the CacheState computed by DetectChanges,
+	// pending a call to PersistState.  It is deliberately not
+	// written to StatePath until the caller confirms that every
+	// cache write for this run actually succeeded; see PersistState.
+	nextState *CacheState
+
+	// EntityRules and GroupRules are the compiled include/exclude
+	// predicates sourced from the include_entities/exclude_entities
+	// and include_groups/exclude_groups config keys.  They are
+	// evaluated in addition to MinUID/MinGID, so existing configs
+	// that only set the numeric cutoffs keep working unchanged.
+	EntityRules *RuleSet
+	GroupRules  *RuleSet
+
+	// DryRun, when true, doesn't change what gets filtered, but
+	// causes every filtering decision to be recorded in decisions
+	// so that DumpDecisions can report it without requiring a real
+	// cache rewrite.
+	DryRun    bool
+	decisions []FilterDecision
+
+	// HostTag identifies this host for the purposes of host-scoped
+	// access control: an entity is only emitted into passwd/shadow
+	// if it's a member of the "login-<HostTag>" group, or its
+	// AllowedHosts KV metadata lists HostTag (or "ALL").  An empty
+	// HostTag (the default) disables this check entirely, exposing
+	// every loaded entity as before.  Groups are always emitted in
+	// full regardless of HostTag, so file ownership still resolves
+	// for members who aren't permitted to log in.
+	HostTag string
+
+	// AuditUnauthorized, when true, doesn't omit entities that fail
+	// the HostTag check; instead they're kept in passwd with their
+	// shell forced to nologinShell, so an auditor can see who would
+	// have been denied.
+	AuditUnauthorized bool
+
+	// ShadowSafeDefaults controls what ShadowEntries does when an
+	// entity's KV metadata doesn't set one of the shadow.* aging
+	// keys documented on ShadowEntries.  When false (the default),
+	// a missing key leaves the corresponding shadow(5) field blank,
+	// i.e. that aspect of aging is disabled, matching NetAuth's
+	// current behavior of not enforcing password aging itself.
+	// When true, a missing shadow.max_days, shadow.warn_days or
+	// shadow.inactive_days falls back to a conservative default
+	// instead, so sites that want aging enforced everywhere can set
+	// this rather than having to populate every entity's metadata;
+	// the other shadow.* keys still leave their fields blank.
+	ShadowSafeDefaults bool
+
 	c *netauth.Client
 
 	l hclog.Logger
 }
 
+// A ChangeSummary describes the result of comparing the current
+// directory contents against the persisted CacheState for an
+// incremental run.
+type ChangeSummary struct {
+	Added   int
+	Changed int
+	Removed int
+}
+
+// Dirty returns true if the ChangeSummary reflects any change at all.
+func (c ChangeSummary) Dirty() bool {
+	return c.Added != 0 || c.Changed != 0 || c.Removed != 0
+}
+
 // NewCacheFiller returns an interface that can be used to fill caches
-// using the libnss library.
-func NewCacheFiller(minuid, mingid int32, defshell, defhome string, shells []string) (source.Source, error) {
+// using the libnss library.  If incremental is true, statePath is
+// used to persist per-entity/per-group content hashes between runs so
+// that DetectChanges can report what actually needs to be
+// re-templated.  include_entities/exclude_entities and
+// include_groups/exclude_groups are read from viper to build the
+// filtering rules applied on top of minuid/mingid.
+//
+// client, if non-nil, is reused as-is instead of dialing and
+// authenticating a new netauth.Client, so a caller that refreshes
+// repeatedly (the daemon's refresh loop) can keep that connection
+// warm across calls rather than paying its setup cost on every tick.
+// A nil client causes one to be created, matching a one-shot run.
+// Either way, every call still performs a full directory sweep: the
+// whole point of a refresh is to notice what changed since the last
+// one, so there's no way to keep the sweep itself warm without also
+// missing changes; --incremental is what keeps repeated sweeps cheap,
+// by skipping the cache rewrite (not the sweep) when nothing changed.
+func NewCacheFiller(minuid, mingid int32, defshell, defhome string, shells []string, incremental bool, statePath string, dryRun bool, hostTag string, auditUnauthorized bool, shadowSafeDefaults bool, client *netauth.Client) (source.Source, error) {
+	entityRules, err := compileRuleSet("include_entities", "exclude_entities")
+	if err != nil {
+		return nil, err
+	}
+	groupRules, err := compileRuleSet("include_groups", "exclude_groups")
+	if err != nil {
+		return nil, err
+	}
+
 	x := NetAuthCacheFiller{
-		entities: make(map[string]*pb.Entity),
-		groups:   make(map[string]*pb.Group),
-		members:  make(map[string][]string),
-		pgroups:  make(map[string]uint32),
+		entities:     make(map[string]*pb.Entity),
+		groups:       make(map[string]*pb.Group),
+		members:      make(map[string][]string),
+		pgroups:      make(map[string]uint32),
+		groupMeta:    make(map[string]map[string]string),
+		entityMeta:   make(map[string]map[string]string),
+		unauthorized: make(map[string]bool),
 
 		MinUID: minuid,
 		MinGID: mingid,
@@ -73,17 +210,33 @@ func NewCacheFiller(minuid, mingid int32, defshell, defhome string, shells []str
 
 		DefaultHome: defhome,
 
+		Incremental: incremental,
+		StatePath:   statePath,
+
+		EntityRules: entityRules,
+		GroupRules:  groupRules,
+		DryRun:      dryRun,
+
+		HostTag:           hostTag,
+		AuditUnauthorized: auditUnauthorized,
+
+		ShadowSafeDefaults: shadowSafeDefaults,
+
 		l: hclog.L().Named("cachefiller"),
 	}
 
 	ctx := context.Background()
 
-	c, err := netauth.New()
-	if err != nil {
-		x.l.Error("Error during client initialization", "error", err)
-		return nil, err
+	c := client
+	if c == nil {
+		var err error
+		c, err = netauth.New()
+		if err != nil {
+			x.l.Error("Error during client initialization", "error", err)
+			return nil, err
+		}
+		c.SetServiceName("nsscache")
 	}
-	c.SetServiceName("nsscache")
 	x.c = c
 
 	if err := x.findGroups(ctx); err != nil {
@@ -96,15 +249,115 @@ func NewCacheFiller(minuid, mingid int32, defshell, defhome string, shells []str
 		return nil, err
 	}
 
+	if err := x.applyHostScope(ctx); err != nil {
+		return nil, err
+	}
+
+	if x.Incremental {
+		if err := x.DetectChanges(); err != nil {
+			return nil, err
+		}
+	}
+
 	return &x, nil
 }
 
+// DetectChanges compares the currently loaded entities and groups
+// against the content hashes persisted at StatePath and populates the
+// filler's ChangeSummary.  It stages the new hashes on nc.nextState
+// but does not persist them: a caller that goes on to skip or fail
+// the actual cache rewrite must not have StatePath advanced out from
+// under it, so PersistState has to be called explicitly once the
+// rewrite has succeeded.  It's a no-op if Incremental is false.
+func (nc *NetAuthCacheFiller) DetectChanges() error {
+	if !nc.Incremental {
+		return nil
+	}
+
+	prev, err := LoadState(nc.StatePath)
+	if err != nil {
+		return err
+	}
+
+	next := &CacheState{
+		EntityHashes: make(map[string]string, len(nc.entities)),
+		GroupHashes:  make(map[string]string, len(nc.groups)),
+	}
+
+	var summary ChangeSummary
+	for id, e := range nc.entities {
+		sum := hashEntity(e, nc.entityMeta[id])
+		if nc.unauthorized[id] {
+			// hashEntity can't see the nologin shell that
+			// PasswdEntries substitutes for an audited-out entity.
+			sum += "|unauthorized"
+		}
+		next.EntityHashes[id] = sum
+		old, ok := prev.EntityHashes[id]
+		switch {
+		case !ok:
+			summary.Added++
+		case old != sum:
+			summary.Changed++
+		}
+	}
+	for id := range prev.EntityHashes {
+		if _, ok := nc.entities[id]; !ok {
+			summary.Removed++
+		}
+	}
+
+	for name, g := range nc.groups {
+		sum := hashGroup(g, nc.members[name], nc.groupMeta[name])
+		next.GroupHashes[name] = sum
+		old, ok := prev.GroupHashes[name]
+		switch {
+		case !ok:
+			summary.Added++
+		case old != sum:
+			summary.Changed++
+		}
+	}
+	for name := range prev.GroupHashes {
+		if _, ok := nc.groups[name]; !ok {
+			summary.Removed++
+		}
+	}
+
+	nc.changes = summary
+	nc.nextState = next
+	return nil
+}
+
+// Changes returns the ChangeSummary computed by the last call to
+// DetectChanges.  It's the zero value if DetectChanges has not been
+// called.
+func (nc *NetAuthCacheFiller) Changes() ChangeSummary {
+	return nc.changes
+}
+
+// PersistState writes the CacheState staged by DetectChanges to
+// StatePath.  Callers must only call this once every cache write for
+// the run has succeeded; calling it any earlier would advance
+// StatePath past hashes whose corresponding caches were never
+// actually written, so the next incremental run would see no change
+// and skip the rewrite it still owes. It's a no-op if Incremental is
+// false, DryRun is set, or DetectChanges hasn't staged anything to
+// persist.
+func (nc *NetAuthCacheFiller) PersistState() error {
+	if !nc.Incremental || nc.DryRun || nc.nextState == nil {
+		return nil
+	}
+	return nc.nextState.Save(nc.StatePath)
+}
+
 // FillShadowCache fills the shadow cache.  Since NetAuth doesn't
-// provide a way to exfiltrate the secret hashes, the shadow cache
-// just gets filled with *'s.
+// provide a way to exfiltrate the secret hashes, the password hash
+// field is always either "*" or "!" (see ShadowEntries); the aging
+// fields are sourced from entity KV metadata.
 func (nc *NetAuthCacheFiller) FillShadowCache(c *cache.Cache) error {
-	for i := range nc.entities {
-		c.Add(&cache.ShadowEntry{Name: nc.entities[i].GetID(), Passwd: "*"})
+	for _, e := range nc.ShadowEntries() {
+		c.Add(e)
 	}
 	return nil
 }
@@ -112,13 +365,8 @@ func (nc *NetAuthCacheFiller) FillShadowCache(c *cache.Cache) error {
 // FillGroupCache fills in the group cache using information from
 // NetAuth.
 func (nc *NetAuthCacheFiller) FillGroupCache(c *cache.Cache) error {
-	for i := range nc.groups {
-		c.Add(&cache.GroupEntry{
-			Name:   nc.groups[i].GetName(),
-			Passwd: "*",
-			GID:    uint32(nc.groups[i].GetNumber()),
-			Mem:    nc.members[nc.groups[i].GetName()],
-		})
+	for _, e := range nc.GroupEntries() {
+		c.Add(e)
 	}
 	return nil
 }
@@ -127,17 +375,135 @@ func (nc *NetAuthCacheFiller) FillGroupCache(c *cache.Cache) error {
 // makes some choices about where home folders are located and what to
 // fill in for the user's shell if the values aren't fully specified.
 func (nc *NetAuthCacheFiller) FillPasswdCache(c *cache.Cache) error {
+	for _, e := range nc.PasswdEntries() {
+		c.Add(e)
+	}
+	return nil
+}
+
+// PasswdEntries returns the passwd entries for every loaded entity,
+// in no particular order.  Writer implementations are expected to
+// sort and dedup as needed (see sortedPasswd).
+func (nc *NetAuthCacheFiller) PasswdEntries() []*cache.PasswdEntry {
+	out := make([]*cache.PasswdEntry, 0, len(nc.entities))
 	for i := range nc.entities {
-		c.Add(&cache.PasswdEntry{
+		shell := nc.entities[i].GetMeta().GetShell()
+		if nc.unauthorized[i] {
+			shell = nologinShell
+		}
+		out = append(out, &cache.PasswdEntry{
 			Name:   nc.entities[i].GetID(),
 			Passwd: "*",
 			UID:    uint32(nc.entities[i].GetNumber()),
 			GID:    nc.pgroups[nc.entities[i].GetMeta().GetPrimaryGroup()],
 			Dir:    nc.entities[i].GetMeta().GetHome(),
-			Shell:  nc.entities[i].GetMeta().GetShell(),
+			Shell:  shell,
 		})
 	}
-	return nil
+	return out
+}
+
+// GroupEntries returns the group entries for every loaded group, in
+// no particular order.
+func (nc *NetAuthCacheFiller) GroupEntries() []*cache.GroupEntry {
+	out := make([]*cache.GroupEntry, 0, len(nc.groups))
+	for i := range nc.groups {
+		out = append(out, &cache.GroupEntry{
+			Name:   nc.groups[i].GetName(),
+			Passwd: "*",
+			GID:    uint32(nc.groups[i].GetNumber()),
+			Mem:    nc.members[nc.groups[i].GetName()],
+		})
+	}
+	return out
+}
+
+// The shadow.* KV keys read by ShadowEntries to populate the shadow(5)
+// aging fields for an entity.  All are optional; an entity with none
+// of them set gets a fully blank (aging disabled) shadow line unless
+// ShadowSafeDefaults is set, in which case the shadowDefault* values
+// below are substituted instead.
+const (
+	metaShadowLocked     = "shadow.locked"        // "true"/"1" forces Passwd to "!" instead of "*"
+	metaShadowLastChange = "shadow.last_change"   // lstchg: days since epoch the password was last changed
+	metaShadowMinDays    = "shadow.min_days"      // min: days required between password changes
+	metaShadowMaxDays    = "shadow.max_days"      // max: days a password stays valid
+	metaShadowWarnDays   = "shadow.warn_days"     // warn: days before expiry a warning is shown
+	metaShadowInactDays  = "shadow.inactive_days" // inact: days after expiry before the account is disabled
+	metaShadowExpireDate = "shadow.expire_date"   // expire: days since epoch the account itself expires
+)
+
+// shadowDefaultMax, shadowDefaultWarn and shadowDefaultInact are the
+// values substituted for a missing shadow.max_days/warn_days/
+// inactive_days when ShadowSafeDefaults is set.  last_change,
+// min_days and expire_date stay blank when unset regardless of
+// ShadowSafeDefaults; min_days and expire_date have no safe non-blank
+// default, since 0 and "expires today" are both actively harmful
+// guesses.
+const (
+	shadowDefaultMax   = 90
+	shadowDefaultWarn  = 7
+	shadowDefaultInact = 30
+)
+
+// ShadowEntries returns the shadow entries for every loaded entity, in
+// no particular order.  Since NetAuth has no notion of a password
+// hash, Passwd is always "*", or "!" if the entity's shadow.locked KV
+// metadata is "true" or "1", matching how passwd -l represents a
+// locked account.
+//
+// The remaining shadow(5) aging fields are sourced from the entity's
+// KV metadata, read via the metaShadow* keys above (e.g.
+// shadow.max_days, shadow.expire_date): each key holds the decimal
+// value for its field, in the same units shadow(5) uses (days since
+// the epoch for last_change/expire_date, a day count for the rest).
+// A key that's unset or doesn't parse as an integer is treated as
+// unset and logged as a warning in the latter case. An unset key
+// leaves that field blank unless ShadowSafeDefaults is set, in which
+// case max_days/warn_days/inactive_days fall back to a conservative
+// default (see shadowDefault* above); last_change, min_days and
+// expire_date are always left blank when unset.
+func (nc *NetAuthCacheFiller) ShadowEntries() []*cache.ShadowEntry {
+	out := make([]*cache.ShadowEntry, 0, len(nc.entities))
+	for i := range nc.entities {
+		meta := nc.entityMeta[i]
+
+		passwd := "*"
+		if v := meta[metaShadowLocked]; v == "true" || v == "1" {
+			passwd = "!"
+		}
+
+		out = append(out, &cache.ShadowEntry{
+			Name:       nc.entities[i].GetID(),
+			Passwd:     passwd,
+			LastChange: nc.shadowAgingField(i, meta, metaShadowLastChange, -1),
+			Min:        nc.shadowAgingField(i, meta, metaShadowMinDays, -1),
+			Max:        nc.shadowAgingField(i, meta, metaShadowMaxDays, shadowDefaultMax),
+			Warn:       nc.shadowAgingField(i, meta, metaShadowWarnDays, shadowDefaultWarn),
+			Inactive:   nc.shadowAgingField(i, meta, metaShadowInactDays, shadowDefaultInact),
+			Expire:     nc.shadowAgingField(i, meta, metaShadowExpireDate, -1),
+		})
+	}
+	return out
+}
+
+// shadowAgingField parses the given shadow.* KV key for entity id out
+// of meta.  A missing or unparseable value falls back to safeDefault
+// if ShadowSafeDefaults is set, or to -1 (rendered as a blank field by
+// shadowLine) otherwise.
+func (nc *NetAuthCacheFiller) shadowAgingField(id string, meta map[string]string, key string, safeDefault int64) int64 {
+	if v, ok := meta[key]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			return n
+		}
+		nc.l.Warn("Ignoring unparseable shadow metadata value",
+			"entity", id, "key", key, "value", v, "error", err)
+	}
+	if nc.ShadowSafeDefaults {
+		return safeDefault
+	}
+	return -1
 }
 
 // findGroups fetches a list of groups from the server and discards
@@ -156,14 +522,70 @@ func (nc *NetAuthCacheFiller) findGroups(ctx context.Context) error {
 				"group", grps[i].GetName(),
 				"limit", nc.MinGID,
 				"gid", grps[i].GetNumber())
+			nc.groupsSkippedMinGID++
 			continue
 		}
+		accepted, reason, err := nc.GroupRules.Eval(map[string]interface{}{
+			"name": grps[i].GetName(),
+			"gid":  int(grps[i].GetNumber()),
+		})
+		if err != nil {
+			return err
+		}
+		nc.recordDecision("group", grps[i].GetName(), accepted, reason)
+		if !accepted {
+			continue
+		}
+
 		nc.groups[grps[i].GetName()] = grps[i]
 		nc.pgroups[grps[i].GetName()] = uint32(grps[i].GetNumber())
+
+		kv, err := nc.c.GroupKV(ctx, grps[i].GetName())
+		if err != nil {
+			nc.l.Warn("Unable to fetch group KV metadata, supplementary maps will ignore this group",
+				"group", grps[i].GetName(),
+				"error", err)
+			continue
+		}
+		nc.groupMeta[grps[i].GetName()] = kv
 	}
 	return nil
 }
 
+// metaValue returns the value of the given KV key on the named group,
+// or the empty string if the group has no KV data or doesn't set that
+// key.
+func (nc *NetAuthCacheFiller) metaValue(group, key string) string {
+	return nc.groupMeta[group][key]
+}
+
+// recordDecision appends a FilterDecision for later --dry-run
+// reporting via DumpDecisions.
+func (nc *NetAuthCacheFiller) recordDecision(kind, id string, accepted bool, reason string) {
+	if !nc.DryRun {
+		return
+	}
+	nc.decisions = append(nc.decisions, FilterDecision{
+		Kind:     kind,
+		ID:       id,
+		Accepted: accepted,
+		Reason:   reason,
+	})
+}
+
+// DumpDecisions logs every recorded FilterDecision, in the form
+// --dry-run is meant to be read in: which rule accepted or rejected
+// each entity/group.
+func (nc *NetAuthCacheFiller) DumpDecisions() {
+	for _, d := range nc.decisions {
+		verb := "accepted"
+		if !d.Accepted {
+			verb = "rejected"
+		}
+		nc.l.Info(fmt.Sprintf("%s %s: %s", d.Kind, verb, d.ID), "reason", d.Reason)
+	}
+}
+
 // findEntities fetches a list of entities from the server and
 // discards entities with a UID below the specicified minimum or with
 // an invalid primary group.  Then, the default shell is checked
@@ -193,6 +615,25 @@ func (nc *NetAuthCacheFiller) findEntities(ctx context.Context) error {
 				"entity", ents[i].GetID())
 			continue
 		}
+
+		accepted, reason, err := nc.EntityRules.Eval(map[string]interface{}{
+			"name": ents[i].GetID(),
+			"uid":  int(ents[i].GetNumber()),
+			"meta": map[string]interface{}{
+				"primary_group": ents[i].GetMeta().GetPrimaryGroup(),
+				"home":          ents[i].GetMeta().GetHome(),
+				"shell":         ents[i].GetMeta().GetShell(),
+				"gecos":         ents[i].GetMeta().GetGECOS(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		nc.recordDecision("entity", ents[i].GetID(), accepted, reason)
+		if !accepted {
+			continue
+		}
+
 		if nc.hasBadShell(ents[i].GetMeta().GetShell()) {
 			ents[i].Meta.Shell = &nc.DefaultShell
 		}
@@ -201,10 +642,109 @@ func (nc *NetAuthCacheFiller) findEntities(ctx context.Context) error {
 			ents[i].Meta.Home = &t
 		}
 		nc.entities[ents[i].GetID()] = ents[i]
+
+		kv, err := nc.c.EntityKV(ctx, ents[i].GetID())
+		if err != nil {
+			nc.l.Warn("Unable to fetch entity KV metadata, AllowedHosts will be ignored for this entity",
+				"entity", ents[i].GetID(),
+				"error", err)
+			continue
+		}
+		nc.entityMeta[ents[i].GetID()] = kv
 	}
 	return nil
 }
 
+// nologinShell is substituted in for AuditUnauthorized entities that
+// fail the HostTag access check.
+const nologinShell = "/sbin/nologin"
+
+// resolveLoginGroup returns the set of entity IDs that are members of
+// loginGroup, read directly via GroupMembers rather than from
+// nc.members. login-<tag> groups are typically low-numbered access
+// groups (e.g. gid 100) that would otherwise be silently dropped by
+// findGroups' MinGID cutoff or by include_groups/exclude_groups, which
+// would leave every entity looking unauthorized instead of just the
+// ones that actually are. A login group that doesn't exist or has no
+// members is logged loudly, since with HostTag set that typically
+// means every entity will fail the AllowedHosts fallback too.
+func (nc *NetAuthCacheFiller) resolveLoginGroup(ctx context.Context, loginGroup string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+
+	members, err := nc.c.GroupMembers(ctx, loginGroup)
+	if err != nil {
+		nc.l.Warn("Unable to resolve login group for host-tag; only AllowedHosts metadata will grant access",
+			"group", loginGroup, "host-tag", nc.HostTag, "error", err)
+		return allowed, nil
+	}
+	if len(members) == 0 {
+		nc.l.Warn("Login group for host-tag has no members; only AllowedHosts metadata will grant access",
+			"group", loginGroup, "host-tag", nc.HostTag)
+		return allowed, nil
+	}
+
+	for _, m := range members {
+		allowed[m.GetID()] = true
+	}
+	return allowed, nil
+}
+
+// applyHostScope is a no-op unless HostTag is set.  Otherwise, it
+// determines which loaded entities are permitted to log in to this
+// host, and either removes the rest from nc.entities or, if
+// AuditUnauthorized is set, records them in nc.unauthorized so
+// PasswdEntries can force their shell to nologin instead of omitting
+// them.
+func (nc *NetAuthCacheFiller) applyHostScope(ctx context.Context) error {
+	if nc.HostTag == "" {
+		return nil
+	}
+
+	loginGroup := "login-" + nc.HostTag
+	allowed, err := nc.resolveLoginGroup(ctx, loginGroup)
+	if err != nil {
+		return err
+	}
+
+	for id := range nc.entities {
+		if allowed[id] {
+			continue
+		}
+		if hostListAllows(nc.entityMeta[id]["AllowedHosts"], nc.HostTag) {
+			allowed[id] = true
+		}
+	}
+
+	for id := range nc.entities {
+		if allowed[id] {
+			continue
+		}
+		if nc.AuditUnauthorized {
+			nc.l.Info("Entity is not permitted on this host, forcing nologin shell",
+				"entity", id, "host-tag", nc.HostTag)
+			nc.unauthorized[id] = true
+			continue
+		}
+		nc.l.Info("Entity is not permitted on this host, omitting",
+			"entity", id, "host-tag", nc.HostTag)
+		delete(nc.entities, id)
+	}
+	return nil
+}
+
+// hostListAllows reports whether the comma-separated AllowedHosts
+// value grants access to the given host tag.  "ALL" or "*" grant
+// access to every host.
+func hostListAllows(allowedHosts, hostTag string) bool {
+	for _, h := range strings.Split(allowedHosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "ALL" || h == "*" || h == hostTag {
+			return true
+		}
+	}
+	return false
+}
+
 // findMembers works out from the groups that are valid on the system
 // the effective memberships.  This function is quite expensive to
 // call, so if this is causing performance problems in your
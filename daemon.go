@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// refreshStats is the set of counters exposed over the admin HTTP
+// surface in daemon mode.  It's updated at the end of every
+// refreshCaches call, whether triggered by the timer, a signal, or
+// the /refresh endpoint.
+type refreshStats struct {
+	mu sync.Mutex
+
+	entitiesLoaded int
+	groupsSkipped  int
+
+	lastDuration  time.Duration
+	lastSuccess   time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// lastRefresh holds the most recently observed refreshStats.  It's a
+// package level variable rather than a field on Daemon because
+// refreshCaches (shared with the one-shot code path) has no Daemon to
+// thread through.
+var lastRefresh refreshStats
+
+func (s *refreshStats) recordSuccess(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastDuration = d
+	s.lastSuccess = time.Now()
+	// A success, including one that finds no changes, means the
+	// daemon is healthy again: clear any previously recorded error
+	// so /healthz and nsscache_last_error_timestamp_seconds reflect
+	// the current state rather than the all-time-worst one.
+	s.lastError = ""
+	s.lastErrorTime = time.Time{}
+}
+
+func (s *refreshStats) recordCounts(entitiesLoaded, groupsSkipped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entitiesLoaded = entitiesLoaded
+	s.groupsSkipped = groupsSkipped
+}
+
+func (s *refreshStats) recordError(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastDuration = d
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+// A Daemon keeps the cache filler warm and re-runs refreshCaches on a
+// timer, on SIGHUP, and on demand via its admin HTTP surface.
+type Daemon struct {
+	RefreshInterval time.Duration
+	AdminSocket     string
+
+	refresh chan chan error
+}
+
+// NewDaemon returns a Daemon ready to Run.
+func NewDaemon(refreshInterval time.Duration, adminSocket string) *Daemon {
+	return &Daemon{
+		RefreshInterval: refreshInterval,
+		AdminSocket:     adminSocket,
+		refresh:         make(chan chan error),
+	}
+}
+
+// Run starts the daemon's refresh loop and admin HTTP server, and
+// blocks until it receives SIGINT/SIGTERM.
+func (d *Daemon) Run() error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
+
+	srv, err := d.startAdminServer()
+	if err != nil {
+		return fmt.Errorf("starting admin server: %w", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	ticker := time.NewTicker(d.RefreshInterval)
+	defer ticker.Stop()
+
+	log.Info("Daemon started",
+		"refresh-interval", d.RefreshInterval,
+		"admin-socket", d.AdminSocket)
+
+	d.doRefresh("startup")
+
+	for {
+		select {
+		case <-ticker.C:
+			d.doRefresh("interval")
+
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGHUP:
+				d.doRefresh("SIGHUP")
+			case syscall.SIGUSR1:
+				d.dumpState()
+			default:
+				log.Info("Daemon shutting down", "signal", sig)
+				return nil
+			}
+
+		case reply := <-d.refresh:
+			reply <- d.doRefresh("admin")
+		}
+	}
+}
+
+// doRefresh runs one refreshCaches cycle, records the result in
+// lastRefresh, and logs the outcome tagged with why the refresh was
+// triggered.
+func (d *Daemon) doRefresh(reason string) error {
+	start := time.Now()
+	skipped, err := refreshCaches()
+	elapsed := time.Since(start)
+
+	if err != nil && err != errNoChange {
+		lastRefresh.recordError(elapsed, err)
+		log.Error("Refresh failed", "reason", reason, "error", err)
+		return err
+	}
+
+	lastRefresh.recordSuccess(elapsed)
+	if err == errNoChange {
+		log.Info("Refresh found no changes", "reason", reason, "duration", elapsed)
+		return nil
+	}
+	if !skipped {
+		log.Info("Refresh complete", "reason", reason, "duration", elapsed)
+	}
+	return nil
+}
+
+// dumpState logs the in-memory refresh stats, for SIGUSR1 driven
+// debugging without needing the admin socket.
+func (d *Daemon) dumpState() {
+	lastRefresh.mu.Lock()
+	defer lastRefresh.mu.Unlock()
+	log.Info("Dumping current state",
+		"entities-loaded", lastRefresh.entitiesLoaded,
+		"groups-skipped-min-gid", lastRefresh.groupsSkipped,
+		"last-duration", lastRefresh.lastDuration,
+		"last-success", lastRefresh.lastSuccess,
+		"last-error", lastRefresh.lastError)
+}
+
+// startAdminServer brings up the /healthz, /metrics and /refresh
+// endpoints on a Unix socket.  The socket is created with permissions
+// restricted to its owner; /refresh additionally checks the
+// connecting peer's credentials via SO_PEERCRED so that any process
+// able to reach the socket (e.g. a misconfigured shared mount) can't
+// trigger a refresh, only the user nsscache runs as.
+func (d *Daemon) startAdminServer() (*http.Server, error) {
+	os.Remove(d.AdminSocket)
+
+	l, err := net.Listen("unix", d.AdminSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(d.AdminSocket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	mux.HandleFunc("/metrics", d.handleMetrics)
+	mux.HandleFunc("/refresh", d.handleRefresh)
+
+	srv := &http.Server{
+		Handler: mux,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, c)
+		},
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("Admin server exited", "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+func (d *Daemon) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	lastRefresh.mu.Lock()
+	lastErr := lastRefresh.lastError
+	lastRefresh.mu.Unlock()
+
+	if lastErr != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "error: %s\n", lastErr)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (d *Daemon) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	lastRefresh.mu.Lock()
+	defer lastRefresh.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP nsscache_entities_loaded Number of entities loaded on the last refresh.\n")
+	fmt.Fprintf(w, "# TYPE nsscache_entities_loaded gauge\n")
+	fmt.Fprintf(w, "nsscache_entities_loaded %d\n", lastRefresh.entitiesLoaded)
+
+	fmt.Fprintf(w, "# HELP nsscache_groups_skipped_min_gid Groups dropped for having a GID below --min-gid on the last refresh.\n")
+	fmt.Fprintf(w, "# TYPE nsscache_groups_skipped_min_gid gauge\n")
+	fmt.Fprintf(w, "nsscache_groups_skipped_min_gid %d\n", lastRefresh.groupsSkipped)
+
+	fmt.Fprintf(w, "# HELP nsscache_refresh_duration_seconds Duration of the last refresh.\n")
+	fmt.Fprintf(w, "# TYPE nsscache_refresh_duration_seconds gauge\n")
+	fmt.Fprintf(w, "nsscache_refresh_duration_seconds %f\n", lastRefresh.lastDuration.Seconds())
+
+	fmt.Fprintf(w, "# HELP nsscache_last_error_timestamp_seconds Unix time of the last failed refresh, 0 if none.\n")
+	fmt.Fprintf(w, "# TYPE nsscache_last_error_timestamp_seconds gauge\n")
+	var lastErrTS int64
+	if !lastRefresh.lastErrorTime.IsZero() {
+		lastErrTS = lastRefresh.lastErrorTime.Unix()
+	}
+	fmt.Fprintf(w, "nsscache_last_error_timestamp_seconds %d\n", lastErrTS)
+
+	fmt.Fprintf(w, "# HELP nsscache_cache_file_mtime_seconds Unix mtime of each cache file as of the last refresh.\n")
+	fmt.Fprintf(w, "# TYPE nsscache_cache_file_mtime_seconds gauge\n")
+	for _, name := range cacheFileNames(*format) {
+		info, err := os.Stat(*outDir + "/" + name)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "nsscache_cache_file_mtime_seconds{file=%q} %d\n", name, info.ModTime().Unix())
+	}
+}
+
+// connCtxKey is the context key ConnContext stashes the raw net.Conn
+// under, so handleRefresh can recover it to check SO_PEERCRED.
+type connCtxKey struct{}
+
+func (d *Daemon) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn, _ := r.Context().Value(connCtxKey{}).(net.Conn)
+	if allowed, err := peerCredAllowed(conn); err != nil || !allowed {
+		if err != nil {
+			log.Error("Unable to check peer credentials for /refresh", "error", err)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "refresh is only permitted for the user nsscache runs as")
+		return
+	}
+
+	reply := make(chan error, 1)
+	d.refresh <- reply
+	if err := <-reply; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "refresh failed: %s\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRecordSuccessClearsError verifies that a refresh recorded as
+// successful clears any error left behind by an earlier failed
+// refresh, so /healthz and nsscache_last_error_timestamp_seconds
+// reflect the daemon's current state rather than its all-time worst.
+func TestRecordSuccessClearsError(t *testing.T) {
+	var s refreshStats
+
+	s.recordError(time.Second, errors.New("transient failure"))
+	if s.lastError == "" {
+		t.Fatal("recordError did not set lastError")
+	}
+
+	s.recordSuccess(time.Second)
+	if s.lastError != "" {
+		t.Fatalf("recordSuccess left lastError set to %q, want cleared", s.lastError)
+	}
+	if !s.lastErrorTime.IsZero() {
+		t.Fatalf("recordSuccess left lastErrorTime set to %v, want zero", s.lastErrorTime)
+	}
+}
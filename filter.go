@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/spf13/viper"
+)
+
+// A RuleSet is a compiled pair of include/exclude predicates, sourced
+// from viper config keys such as include_entities/exclude_entities or
+// include_groups/exclude_groups.  An empty RuleSet (no include
+// program) accepts everything, preserving the old MinUID/MinGID-only
+// behavior for sites that don't configure one.
+type RuleSet struct {
+	include    *vm.Program
+	includeSrc string
+
+	exclude    *vm.Program
+	excludeSrc string
+}
+
+// compileRuleSet reads includeKey/excludeKey from viper and compiles
+// whichever of them is set.  It's not an error for either key to be
+// unset.
+func compileRuleSet(includeKey, excludeKey string) (*RuleSet, error) {
+	rs := &RuleSet{}
+
+	if src := viper.GetString(includeKey); src != "" {
+		p, err := expr.Compile(src, expr.AsBool())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", includeKey, err)
+		}
+		rs.include = p
+		rs.includeSrc = src
+	}
+
+	if src := viper.GetString(excludeKey); src != "" {
+		p, err := expr.Compile(src, expr.AsBool())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", excludeKey, err)
+		}
+		rs.exclude = p
+		rs.excludeSrc = src
+	}
+
+	return rs, nil
+}
+
+// A FilterDecision records why a single entity or group was accepted
+// or rejected, for --dry-run reporting.
+type FilterDecision struct {
+	Kind     string // "entity" or "group"
+	ID       string
+	Accepted bool
+	Reason   string
+}
+
+// Eval runs the deny rule (if any) and then the include rule (if
+// any) against env, and reports which one decided the outcome.
+func (rs *RuleSet) Eval(env map[string]interface{}) (bool, string, error) {
+	if rs.exclude != nil {
+		out, err := expr.Run(rs.exclude, env)
+		if err != nil {
+			return false, "", fmt.Errorf("evaluating exclude rule %q: %w", rs.excludeSrc, err)
+		}
+		if out.(bool) {
+			return false, fmt.Sprintf("rejected by exclude rule: %s", rs.excludeSrc), nil
+		}
+	}
+
+	if rs.include != nil {
+		out, err := expr.Run(rs.include, env)
+		if err != nil {
+			return false, "", fmt.Errorf("evaluating include rule %q: %w", rs.includeSrc, err)
+		}
+		if !out.(bool) {
+			return false, fmt.Sprintf("rejected, did not match include rule: %s", rs.includeSrc), nil
+		}
+		return true, fmt.Sprintf("accepted by include rule: %s", rs.includeSrc), nil
+	}
+
+	return true, "accepted, no include rule configured", nil
+}
@@ -5,14 +5,21 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/netauth/netauth/pkg/netauth"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-
-	nsscache "github.com/MiLk/nsscache-go"
 )
 
+// exitNoChange is returned when running in incremental mode and the
+// run produced no changes to the on disk caches.  Callers such as
+// cron or a systemd timer can use this to skip any downstream reload
+// hooks (e.g. an rsync push) that would otherwise be triggered on
+// every run regardless of whether anything actually changed.
+const exitNoChange = 3
+
 var (
 	systemShells []string
 
@@ -25,7 +32,33 @@ var (
 	outDir  = pflag.String("out", "/etc", "Output directory for cache files")
 	cfgfile = pflag.String("config", "", "Config file to use")
 
+	incremental = pflag.Bool("incremental", false, "Only re-template entities/groups that changed since the last run")
+	statePath   = pflag.String("state-path", "/var/lib/nsscache/state.gob", "Where to persist change-detection state in incremental mode")
+
+	format = pflag.String("format", "files", "Output format to write: files, files+index, bdb, gdbm")
+
+	enabledMaps = pflag.StringSlice("enable-map", nil, "Supplementary maps to generate in addition to passwd/group/shadow: netgroup, automount, sudoers")
+
+	dryRun = pflag.Bool("dry-run", false, "Evaluate include_entities/include_groups (and their exclude_ counterparts) and report the decision for each entity/group, without writing any caches")
+
+	hostTag           = pflag.String("host-tag", "", "Tag identifying this host for the login-<tag> group / AllowedHosts access check; defaults to auto-detecting via os.Hostname() if unset and --enable-host-scope is passed")
+	enableHostScope   = pflag.Bool("enable-host-scope", false, "Only emit entities permitted to log in to this host (see --host-tag)")
+	auditUnauthorized = pflag.Bool("audit-unauthorized", false, "With --enable-host-scope, keep unauthorized entities in passwd with their shell forced to nologin instead of omitting them")
+
+	shadowSafeDefaults = pflag.Bool("shadow-safe-defaults", false, "Fall back to conservative max/warn/inactive day defaults when an entity's shadow.* KV metadata doesn't set them, instead of leaving those fields blank")
+
+	daemon          = pflag.Bool("daemon", false, "Run as a long lived daemon instead of exiting after one refresh")
+	refreshInterval = pflag.Duration("refresh-interval", 15*time.Minute, "How often the daemon refreshes its caches")
+	adminSocket     = pflag.String("admin-socket", "/run/nsscache/admin.sock", "Unix socket the daemon's /healthz, /metrics and /refresh admin endpoints listen on")
+
 	log hclog.Logger
+
+	// warmClient holds the netauth.Client from the previous call to
+	// refreshCaches, so the daemon's refresh loop reuses the same
+	// connection on every tick instead of re-dialing and
+	// re-authenticating from scratch. A one-shot, non-daemon run
+	// sets it once and never reuses it.
+	warmClient *netauth.Client
 )
 
 func initialize() {
@@ -68,23 +101,122 @@ func main() {
 	// Perform initialization
 	initialize()
 
-	filler, err := NewCacheFiller(int32(*minUID), int32(*minGID), *defShell, *defHomeDir, systemShells)
+	if *daemon {
+		d := NewDaemon(*refreshInterval, *adminSocket)
+		if err := d.Run(); err != nil {
+			log.Error("Daemon exited with an error: ", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	skipped, err := refreshCaches()
+	if err == errNoChange {
+		log.Info("No changes detected since last run, skipping cache rewrite")
+		os.Exit(exitNoChange)
+	}
 	if err != nil {
-		log.Error("Error initializing Cache Filler: ", "error", err)
+		log.Error("Error refreshing caches: ", "error", err)
 		os.Exit(1)
 	}
+	if skipped {
+		return
+	}
+	log.Info("Caches Updated")
+}
 
-	cm := nsscache.NewCaches()
-	if err := cm.FillCaches(filler); err != nil {
-		log.Error("Unable to fill caches: ", "error", err)
-		os.Exit(1)
+// errNoChange is returned by refreshCaches when running in
+// incremental mode and the run produced no changes to the on disk
+// caches.
+var errNoChange = fmt.Errorf("no changes since last run")
+
+// refreshCaches performs one full cycle of loading the directory and
+// writing out the enabled caches using the configured output format.
+// It's used both for the default one-shot invocation and for every
+// tick of the daemon's refresh loop.
+func refreshCaches() (bool, error) {
+	tag := *hostTag
+	if *enableHostScope && tag == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return false, fmt.Errorf("auto-detecting --host-tag: %w", err)
+		}
+		tag = h
+	}
+	if !*enableHostScope {
+		tag = ""
 	}
 
-	err = cm.WriteFiles(&nsscache.WriteOptions{
-		Directory: *outDir,
-	})
+	filler, err := NewCacheFiller(int32(*minUID), int32(*minGID), *defShell, *defHomeDir, systemShells, *incremental, *statePath, *dryRun, tag, *auditUnauthorized, *shadowSafeDefaults, warmClient)
 	if err != nil {
-		log.Error("Error writing updated caches: ", "error", err)
+		return false, fmt.Errorf("initializing cache filler: %w", err)
 	}
-	log.Info("Caches Updated")
+
+	nc, ok := filler.(*NetAuthCacheFiller)
+	if !ok {
+		return false, fmt.Errorf("cache filler does not support the writer pipeline")
+	}
+	warmClient = nc.c
+
+	if *dryRun {
+		nc.DumpDecisions()
+		return true, nil
+	}
+
+	if *incremental && !nc.Changes().Dirty() {
+		return false, errNoChange
+	}
+
+	writer, err := NewWriter(*format, *outDir)
+	if err != nil {
+		return false, fmt.Errorf("selecting output format: %w", err)
+	}
+
+	if err := writer.WritePasswd(nc.PasswdEntries()); err != nil {
+		return false, fmt.Errorf("writing passwd cache: %w", err)
+	}
+	if err := writer.WriteGroup(nc.GroupEntries()); err != nil {
+		return false, fmt.Errorf("writing group cache: %w", err)
+	}
+	if err := writer.WriteShadow(nc.ShadowEntries()); err != nil {
+		return false, fmt.Errorf("writing shadow cache: %w", err)
+	}
+
+	for _, m := range *enabledMaps {
+		switch m {
+		case "netgroup":
+			if err := writer.WriteNetgroup(nc.NetgroupEntries()); err != nil {
+				return false, fmt.Errorf("writing netgroup cache: %w", err)
+			}
+		case "automount":
+			if err := writer.WriteAutomount(nc.AutomountEntries()); err != nil {
+				return false, fmt.Errorf("writing automount caches: %w", err)
+			}
+		case "sudoers":
+			if err := writer.WriteSudoers(nc.SudoersEntries()); err != nil {
+				return false, fmt.Errorf("writing sudoers cache: %w", err)
+			}
+		default:
+			log.Error("Unknown --enable-map value, ignoring", "map", m)
+		}
+	}
+
+	lastRefresh.recordCounts(len(nc.entities), nc.groupsSkippedMinGID)
+
+	if *incremental {
+		// Only advance StatePath now that every cache above has
+		// actually been written; doing this any earlier would let a
+		// later write failure leave StatePath referencing hashes
+		// whose caches were never rewritten.
+		if err := nc.PersistState(); err != nil {
+			return false, fmt.Errorf("persisting incremental state: %w", err)
+		}
+		changes := nc.Changes()
+		log.Info("Caches Updated",
+			"added", changes.Added,
+			"changed", changes.Changed,
+			"removed", changes.Removed)
+		return true, nil
+	}
+	return false, nil
 }
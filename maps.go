@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metadata keys consulted when projecting NetAuth groups into the
+// supplementary maps below.  None of these require a server side
+// schema change: they're just well-known keys in a group's metadata,
+// the same mechanism used for things like PrimaryGroup.
+const (
+	metaNetgroup       = "netgroup"
+	metaAutomountMap   = "automount.map"
+	metaAutomountKey   = "automount.key"
+	metaAutomountValue = "automount.value"
+	metaSudoersHosts   = "sudoers.hosts"
+	metaSudoersRunAs   = "sudoers.runas"
+	metaSudoersCmds    = "sudoers.commands"
+)
+
+// automountMasterMap is the well known name of the automount master
+// map, which maps mount points to the name of the map that serves
+// them.
+const automountMasterMap = "auto.master"
+
+// A NetgroupEntry is a single netgroup(5) line: a name plus the
+// (host,user,domain) triples that make it up.
+type NetgroupEntry struct {
+	Name    string
+	Triples []NetgroupTriple
+}
+
+// A NetgroupTriple is one (host,user,domain) member of a netgroup.
+// An empty field means "any" per netgroup(5).
+type NetgroupTriple struct {
+	Host   string
+	User   string
+	Domain string
+}
+
+// Line renders e as a netgroup(5) line.
+func (e *NetgroupEntry) Line() string {
+	triples := make([]string, len(e.Triples))
+	for i, t := range e.Triples {
+		triples[i] = fmt.Sprintf("(%s,%s,%s)", t.Host, t.User, t.Domain)
+	}
+	return fmt.Sprintf("%s %s", e.Name, strings.Join(triples, " "))
+}
+
+// An AutomountEntry is a single key/value pair within one automount
+// map (e.g. within "auto.home", or within the "auto.master" map
+// itself).
+type AutomountEntry struct {
+	Key   string
+	Value string
+}
+
+// Line renders e as an autofs(5) map line.
+func (e *AutomountEntry) Line() string {
+	return fmt.Sprintf("%-16s %s", e.Key, e.Value)
+}
+
+// A SudoersEntry is the sudoers.d(5) fragment generated for a single
+// NetAuth group's sudoRole-equivalent metadata.
+type SudoersEntry struct {
+	// Name is used both as the %group in the generated rule and
+	// as the nsscache-<Name> suffix of the sudoers.d file it's
+	// written to.
+	Name     string
+	Hosts    string
+	RunAs    string
+	Commands string
+}
+
+// Line renders e as a single sudoers(5) rule.
+func (e *SudoersEntry) Line() string {
+	return fmt.Sprintf("%%%s %s=(%s) %s", e.Name, e.Hosts, e.RunAs, e.Commands)
+}
+
+// NetgroupEntries projects every loaded group that carries a
+// metaNetgroup value into a netgroup, with the group's resolved
+// members as the netgroup's users.  The netgroup name is taken from
+// the metadata value rather than the group name, so a single NetAuth
+// group can be exposed under a different netgroup name if desired.
+func (nc *NetAuthCacheFiller) NetgroupEntries() []*NetgroupEntry {
+	var out []*NetgroupEntry
+	for name := range nc.groups {
+		netgroupName := nc.metaValue(name, metaNetgroup)
+		if netgroupName == "" {
+			continue
+		}
+		triples := make([]NetgroupTriple, 0, len(nc.members[name]))
+		for _, user := range nc.members[name] {
+			triples = append(triples, NetgroupTriple{User: user})
+		}
+		out = append(out, &NetgroupEntry{Name: netgroupName, Triples: triples})
+	}
+	return out
+}
+
+// AutomountEntries projects every loaded group that carries
+// metaAutomountMap/metaAutomountKey/metaAutomountValue metadata into
+// a set of per-map key/value entries, keyed by map name.  If no group
+// supplies an explicit "auto.master" entry and at least one other map
+// was seen, a synthetic "auto.master" map is added, built from the
+// distinct map names that were seen, mounting a map "auto.foo" at
+// "/foo".  Any explicit auto.master entry suppresses the synthetic
+// entries for every map, not just its own.
+func (nc *NetAuthCacheFiller) AutomountEntries() map[string][]*AutomountEntry {
+	out := make(map[string][]*AutomountEntry)
+	seenMaps := make(map[string]bool)
+
+	for name := range nc.groups {
+		mapName := nc.metaValue(name, metaAutomountMap)
+		key := nc.metaValue(name, metaAutomountKey)
+		value := nc.metaValue(name, metaAutomountValue)
+		if mapName == "" || key == "" || value == "" {
+			continue
+		}
+		out[mapName] = append(out[mapName], &AutomountEntry{Key: key, Value: value})
+		if mapName != automountMasterMap {
+			seenMaps[mapName] = true
+		}
+	}
+
+	if _, ok := out[automountMasterMap]; !ok && len(seenMaps) > 0 {
+		for mapName := range seenMaps {
+			mountPoint := "/" + strings.TrimPrefix(mapName, "auto.")
+			out[automountMasterMap] = append(out[automountMasterMap], &AutomountEntry{
+				Key:   mountPoint,
+				Value: mapName,
+			})
+		}
+	}
+
+	for mapName := range out {
+		sort.Slice(out[mapName], func(i, j int) bool {
+			return out[mapName][i].Key < out[mapName][j].Key
+		})
+	}
+	return out
+}
+
+// SudoersEntries projects every loaded group that carries the
+// metaSudoersCmds metadata into a SudoersEntry.  metaSudoersHosts and
+// metaSudoersRunAs default to "ALL" when unset, matching the usual
+// sudoers(5) shorthand.
+func (nc *NetAuthCacheFiller) SudoersEntries() []*SudoersEntry {
+	var out []*SudoersEntry
+	for name, g := range nc.groups {
+		cmds := nc.metaValue(name, metaSudoersCmds)
+		if cmds == "" {
+			continue
+		}
+		hosts := nc.metaValue(name, metaSudoersHosts)
+		if hosts == "" {
+			hosts = "ALL"
+		}
+		runas := nc.metaValue(name, metaSudoersRunAs)
+		if runas == "" {
+			runas = "ALL"
+		}
+		out = append(out, &SudoersEntry{
+			Name:     g.GetName(),
+			Hosts:    hosts,
+			RunAs:    runas,
+			Commands: cmds,
+		})
+	}
+	return out
+}
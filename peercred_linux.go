@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCredAllowed reports whether the peer on the other end of conn
+// is running as the same user as this process, using SO_PEERCRED.
+// conn must be the *net.UnixConn backing an admin socket connection;
+// any other type (or a nil conn, which shouldn't happen in practice)
+// is rejected.
+func peerCredAllowed(conn net.Conn) (bool, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false, fmt.Errorf("connection is not a unix socket")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return false, err
+	}
+	if credErr != nil {
+		return false, credErr
+	}
+
+	return cred.Uid == uint32(os.Getuid()), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredAllowed always denies on platforms where SO_PEERCRED isn't
+// available, rather than silently accepting connections it can't
+// verify the origin of.
+func peerCredAllowed(conn net.Conn) (bool, error) {
+	return false, fmt.Errorf("peer credential checking is not implemented on this platform")
+}
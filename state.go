@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	pb "github.com/netauth/protocol"
+)
+
+// A CacheState is the small bit of bookkeeping that's persisted
+// between runs of the cache filler when operating in incremental
+// mode.  It records a content hash for every entity and group that
+// was seen on the last run so that a subsequent run can tell which
+// ones actually need to be re-templated.
+type CacheState struct {
+	// Generation is a slot for a server generation number.
+	// Nothing sets or reads it: DetectChanges persists it empty,
+	// and every run performs the full directory search regardless.
+	Generation string
+
+	// EntityHashes and GroupHashes map entity/group IDs to a
+	// content hash of the fields that affect the rendered cache
+	// entry.
+	EntityHashes map[string]string
+	GroupHashes  map[string]string
+}
+
+// LoadState reads a CacheState from the given path.  If the file does
+// not exist, an empty CacheState is returned with no error, since this
+// is expected on the very first incremental run.
+func LoadState(path string) (*CacheState, error) {
+	s := &CacheState{
+		EntityHashes: make(map[string]string),
+		GroupHashes:  make(map[string]string),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save persists the CacheState to the given path.  The state is
+// written to a temporary file in the same directory and renamed into
+// place so a reader never observes a truncated state file.
+func (s *CacheState) Save(path string) error {
+	tmp := path + ".new"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hashEntity returns a content hash of the fields of an entity that
+// are rendered into the passwd/shadow caches, including the KV
+// metadata (meta) that shadow aging and host-scope rendering draw
+// from. Two entities that hash the same are indistinguishable in the
+// output caches.
+func hashEntity(e *pb.Entity, meta map[string]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%s|%s|%s|%s",
+		e.GetID(),
+		e.GetNumber(),
+		e.GetMeta().GetPrimaryGroup(),
+		e.GetMeta().GetHome(),
+		e.GetMeta().GetShell(),
+		e.GetMeta().GetGECOS(),
+	)
+	hashMeta(h, meta)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashGroup returns a content hash of the fields of a group, plus its
+// resolved membership list and KV metadata (meta) that sudoers,
+// netgroup and automount rendering draw from.
+func hashGroup(g *pb.Group, members []string, meta map[string]string) string {
+	sorted := make([]string, len(members))
+	copy(sorted, members)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d", g.GetName(), g.GetNumber())
+	for _, m := range sorted {
+		fmt.Fprintf(h, "|%s", m)
+	}
+	hashMeta(h, meta)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashMeta folds an entity's or group's KV metadata into h in a
+// deterministic, sorted-by-key order, so that changing e.g.
+// shadow.max_days, AllowedHosts or sudoers.* changes the resulting
+// content hash even though those values live outside the protobuf
+// fields hashed above.
+func hashMeta(h io.Writer, meta map[string]string) {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "|%s=%s", k, meta[k])
+	}
+}
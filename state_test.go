@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPersistStateDryRun verifies that a dry run never advances the
+// persisted incremental state, even if DetectChanges has already
+// staged new hashes: --dry-run --incremental must be safe to run
+// ahead of a real run without causing that real run to see a false
+// "no change" and skip its rewrite.
+func TestPersistStateDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.gob")
+
+	nc := &NetAuthCacheFiller{
+		Incremental: true,
+		DryRun:      true,
+		StatePath:   path,
+		nextState: &CacheState{
+			EntityHashes: map[string]string{"alice": "deadbeef"},
+			GroupHashes:  map[string]string{"staff": "cafef00d"},
+		},
+	}
+
+	if err := nc.PersistState(); err != nil {
+		t.Fatalf("PersistState: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("dry run wrote state file at %s, want no file", path)
+	}
+}
+
+// TestPersistStateWritesAfterRealRun verifies that a non-dry-run
+// incremental call does persist the staged state, so the deferred
+// save introduced alongside this test still actually fires on the
+// success path.
+func TestPersistStateWritesAfterRealRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.gob")
+
+	nc := &NetAuthCacheFiller{
+		Incremental: true,
+		StatePath:   path,
+		nextState: &CacheState{
+			EntityHashes: map[string]string{"alice": "deadbeef"},
+			GroupHashes:  map[string]string{"staff": "cafef00d"},
+		},
+	}
+
+	if err := nc.PersistState(); err != nil {
+		t.Fatalf("PersistState: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected state file at %s: %v", path, err)
+	}
+}
+
+// TestHashEntityCoversMeta guards against a regression where KV
+// metadata like shadow.max_days or AllowedHosts changes silently,
+// since those changes render into the cache output but live outside
+// the protobuf fields hashEntity otherwise hashes. A nil *pb.Entity is
+// enough here since its Get* accessors are nil-safe; only meta varies.
+func TestHashEntityCoversMeta(t *testing.T) {
+	base := hashEntity(nil, map[string]string{"shadow.max_days": "90"})
+	changed := hashEntity(nil, map[string]string{"shadow.max_days": "30"})
+	if base == changed {
+		t.Fatal("hashEntity did not change when meta value changed")
+	}
+
+	reordered := hashEntity(nil, map[string]string{"shadow.max_days": "90"})
+	if base != reordered {
+		t.Fatal("hashEntity is not deterministic for identical meta")
+	}
+}
+
+// TestHashGroupCoversMeta guards against the same class of regression
+// as TestHashEntityCoversMeta, but for group KV metadata such as
+// sudoers.* and netgroup.
+func TestHashGroupCoversMeta(t *testing.T) {
+	members := []string{"alice", "bob"}
+
+	base := hashGroup(nil, members, map[string]string{"sudoers.commands": "ALL"})
+	changed := hashGroup(nil, members, map[string]string{"sudoers.commands": "/bin/ls"})
+	if base == changed {
+		t.Fatal("hashGroup did not change when meta value changed")
+	}
+}
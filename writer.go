@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// A Writer takes the final, de-duplicated set of entries for a given
+// map and persists them in whatever on-disk format it implements.
+// Implementations are responsible for making their own writes atomic
+// (e.g. write-to-temp-then-rename) since libnss readers may be
+// running concurrently against the output.
+type Writer interface {
+	WritePasswd(entries []*cache.PasswdEntry) error
+	WriteGroup(entries []*cache.GroupEntry) error
+	WriteShadow(entries []*cache.ShadowEntry) error
+
+	// WriteNetgroup, WriteAutomount and WriteSudoers are only
+	// called for the maps enabled via --enable-map; a Writer whose
+	// format has no sane representation for one of them (e.g.
+	// sudoers in a BDB/GDBM database) should return a descriptive
+	// error rather than silently dropping the entries.
+	WriteNetgroup(entries []*NetgroupEntry) error
+	WriteAutomount(maps map[string][]*AutomountEntry) error
+	WriteSudoers(entries []*SudoersEntry) error
+}
+
+// NewWriter returns the Writer implementation registered under the
+// given --format name, writing into dir.  An unknown format name is a
+// configuration error and is returned as such.
+func NewWriter(format, dir string) (Writer, error) {
+	switch format {
+	case "files":
+		return &FilesWriter{Directory: dir}, nil
+	case "files+index":
+		return &IndexWriter{FilesWriter: FilesWriter{Directory: dir}}, nil
+	case "bdb":
+		return newBDBWriter(dir)
+	case "gdbm":
+		return newGDBMWriter(dir)
+	default:
+		return nil, fmt.Errorf("unknown cache format %q", format)
+	}
+}
+
+// cacheFileNames returns the passwd/group/shadow file names written
+// by the given --format, for handleMetrics' cache-file mtime gauge.
+// "files" and "files+index" both write the flat files under these
+// names (files+index's .ixname/.ixuid/.ixgid sidecars aren't tracked
+// separately); bdb and gdbm write their own per-format extension.
+func cacheFileNames(format string) []string {
+	switch format {
+	case "bdb":
+		return []string{"passwd.db", "group.db", "shadow.db"}
+	case "gdbm":
+		return []string{"passwd.gdbm", "group.gdbm", "shadow.gdbm"}
+	default:
+		return []string{"passwd.cache", "group.cache", "shadow.cache"}
+	}
+}
+
+// sortedPasswd returns entries sorted by UID and with any duplicate
+// names discarded, keeping the first entry seen for a given name.
+// Downstream writers can assume the slice they receive is already in
+// this canonical order.
+func sortedPasswd(entries []*cache.PasswdEntry) []*cache.PasswdEntry {
+	seen := make(map[string]bool, len(entries))
+	out := make([]*cache.PasswdEntry, 0, len(entries))
+	for _, e := range entries {
+		if seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UID < out[j].UID })
+	return out
+}
+
+// sortedGroup returns entries sorted by GID and with any duplicate
+// names discarded, keeping the first entry seen for a given name.
+func sortedGroup(entries []*cache.GroupEntry) []*cache.GroupEntry {
+	seen := make(map[string]bool, len(entries))
+	out := make([]*cache.GroupEntry, 0, len(entries))
+	for _, e := range entries {
+		if seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GID < out[j].GID })
+	return out
+}
+
+// sortedShadow returns entries sorted by name with any duplicates
+// discarded, keeping the first entry seen for a given name.
+func sortedShadow(entries []*cache.ShadowEntry) []*cache.ShadowEntry {
+	seen := make(map[string]bool, len(entries))
+	out := make([]*cache.ShadowEntry, 0, len(entries))
+	for _, e := range entries {
+		if seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// passwdLine renders a single passwd(5) line for e.  The GECOS field
+// is always left empty.
+func passwdLine(e *cache.PasswdEntry) string {
+	return fmt.Sprintf("%s:%s:%d:%d::%s:%s", e.Name, e.Passwd, e.UID, e.GID, e.Dir, e.Shell)
+}
+
+// groupLine renders a single group(5) line for e.
+func groupLine(e *cache.GroupEntry) string {
+	return fmt.Sprintf("%s:%s:%d:%s", e.Name, e.Passwd, e.GID, joinMembers(e.Mem))
+}
+
+// shadowLine renders a single shadow(5) line for e.  The aging fields
+// (LastChange, Min, Max, Warn, Inactive, Expire) use -1 as the
+// "unset" sentinel set by ShadowEntries, which is rendered as a blank
+// field rather than the literal -1.  Flag is reserved by shadow(5)
+// and always left blank.
+func shadowLine(e *cache.ShadowEntry) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%s:",
+		e.Name, e.Passwd,
+		shadowField(e.LastChange), shadowField(e.Min), shadowField(e.Max),
+		shadowField(e.Warn), shadowField(e.Inactive), shadowField(e.Expire))
+}
+
+// shadowField renders a single shadow(5) aging value, turning the -1
+// "unset" sentinel into a blank field.
+func shadowField(v int64) string {
+	if v < 0 {
+		return ""
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// renameOver renames src over dst, used by the writers that build a
+// whole database file before swapping it into place.
+func renameOver(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+func joinMembers(mem []string) string {
+	out := ""
+	for i, m := range mem {
+		if i > 0 {
+			out += ","
+		}
+		out += m
+	}
+	return out
+}
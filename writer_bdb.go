@@ -0,0 +1,150 @@
+//go:build bdb
+
+package main
+
+// #cgo LDFLAGS: -ldb
+// #include <db.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// A BDBWriter writes Berkeley DB hash databases compatible with
+// nss_db, keyed the same way `makedb` keys them: "." for the primary
+// name lookup, "=" for the numeric id lookup, and a plain decimal
+// iteration cursor ("0", "1", "2", ...) in insertion order so
+// nss_db's getpwent/getgrent/getspent-style sequential enumeration
+// works, not just single-key lookups.  Building this writer requires
+// libdb's headers and the `bdb` build tag (`go build -tags bdb`).
+type BDBWriter struct {
+	Directory string
+}
+
+func newBDBWriter(dir string) (Writer, error) {
+	return &BDBWriter{Directory: dir}, nil
+}
+
+// WritePasswd implements Writer.
+func (w *BDBWriter) WritePasswd(entries []*cache.PasswdEntry) error {
+	sorted := sortedPasswd(entries)
+	pairs := make(map[string]string, len(sorted)*3)
+	for i, e := range sorted {
+		line := passwdLine(e)
+		pairs["."+e.Name] = line
+		pairs[fmt.Sprintf("=%d", e.UID)] = line
+		pairs[strconv.Itoa(i)] = line
+	}
+	return writeBDB(filepath.Join(w.Directory, "passwd.db"), pairs)
+}
+
+// WriteGroup implements Writer.
+func (w *BDBWriter) WriteGroup(entries []*cache.GroupEntry) error {
+	sorted := sortedGroup(entries)
+	pairs := make(map[string]string, len(sorted)*3)
+	for i, e := range sorted {
+		line := groupLine(e)
+		pairs["."+e.Name] = line
+		pairs[fmt.Sprintf("=%d", e.GID)] = line
+		pairs[strconv.Itoa(i)] = line
+	}
+	return writeBDB(filepath.Join(w.Directory, "group.db"), pairs)
+}
+
+// WriteShadow implements Writer.
+func (w *BDBWriter) WriteShadow(entries []*cache.ShadowEntry) error {
+	sorted := sortedShadow(entries)
+	pairs := make(map[string]string, len(sorted)*2)
+	for i, e := range sorted {
+		line := shadowLine(e)
+		pairs["."+e.Name] = line
+		pairs[strconv.Itoa(i)] = line
+	}
+	return writeBDB(filepath.Join(w.Directory, "shadow.db"), pairs)
+}
+
+// WriteNetgroup implements Writer, keying each netgroup by name the
+// same way nss_db's makedb does for the other maps.
+func (w *BDBWriter) WriteNetgroup(entries []*NetgroupEntry) error {
+	pairs := make(map[string]string, len(entries))
+	for _, e := range entries {
+		pairs["."+e.Name] = e.Line()
+	}
+	return writeBDB(filepath.Join(w.Directory, "netgroup.db"), pairs)
+}
+
+// WriteAutomount implements Writer, with one database per map, keyed
+// by mount key.
+func (w *BDBWriter) WriteAutomount(maps map[string][]*AutomountEntry) error {
+	for mapName, entries := range maps {
+		pairs := make(map[string]string, len(entries))
+		for _, e := range entries {
+			pairs["."+e.Key] = e.Value
+		}
+		if err := writeBDB(filepath.Join(w.Directory, fmt.Sprintf("automount.%s.db", mapName)), pairs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSudoers implements Writer.  There's no equivalent of
+// sudoers.d(5) for a Berkeley DB consumer, so this format is
+// rejected rather than silently dropped.
+func (w *BDBWriter) WriteSudoers(entries []*SudoersEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return fmt.Errorf("--format=bdb has no sudoers representation, use --format=files or files+index")
+}
+
+// writeBDB writes pairs into a new Berkeley DB hash database at path,
+// building it in a temp file and renaming it into place so it can be
+// swapped out from under nss_db atomically.
+func writeBDB(path string, pairs map[string]string) error {
+	tmp := path + ".new"
+
+	cTmp := C.CString(tmp)
+	defer C.free(unsafe.Pointer(cTmp))
+
+	var dbp *C.DB
+	if rc := C.db_create(&dbp, nil, 0); rc != 0 {
+		return fmt.Errorf("db_create: %s", C.GoString(C.db_strerror(rc)))
+	}
+
+	if rc := dbp.open(dbp, nil, cTmp, nil, C.DB_HASH, C.DB_CREATE|C.DB_TRUNCATE, 0644); rc != 0 {
+		dbp.close(dbp, 0)
+		return fmt.Errorf("DB->open: %s", C.GoString(C.db_strerror(rc)))
+	}
+
+	for k, v := range pairs {
+		// makedb's own output NUL-terminates both the key and the
+		// value, and nss_db's reader relies on that when it treats
+		// the returned value as a C string; match it here instead
+		// of storing bare, unterminated byte slices.
+		ck, cv := append([]byte(k), 0), append([]byte(v), 0)
+		var key, data C.DBT
+		key.data = unsafe.Pointer(&ck[0])
+		key.size = C.u_int32_t(len(ck))
+		data.data = unsafe.Pointer(&cv[0])
+		data.size = C.u_int32_t(len(cv))
+
+		if rc := dbp.put(dbp, nil, &key, &data, 0); rc != 0 {
+			dbp.close(dbp, 0)
+			return fmt.Errorf("DB->put(%q): %s", k, C.GoString(C.db_strerror(rc)))
+		}
+	}
+
+	// Close (and so flush) the database before renaming it into
+	// place, so nss_db never opens a partially written file.
+	if rc := dbp.close(dbp, 0); rc != 0 {
+		return fmt.Errorf("DB->close: %s", C.GoString(C.db_strerror(rc)))
+	}
+	return renameOver(tmp, path)
+}
@@ -0,0 +1,12 @@
+//go:build !bdb
+
+package main
+
+import "fmt"
+
+// newBDBWriter reports that this binary wasn't built with Berkeley DB
+// support.  Rebuild with `-tags bdb` (and libdb's headers installed)
+// to enable --format=bdb.
+func newBDBWriter(dir string) (Writer, error) {
+	return nil, fmt.Errorf("--format=bdb requires a binary built with -tags bdb")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// A FilesWriter writes plain flat passwd(5)/group(5)/shadow(5) style
+// files into Directory.  Each file is written to a temp file in the
+// same directory and renamed into place so a concurrent libnss reader
+// never observes a partially written file.
+type FilesWriter struct {
+	Directory string
+}
+
+// WritePasswd implements Writer.
+func (w *FilesWriter) WritePasswd(entries []*cache.PasswdEntry) error {
+	lines := make([]string, 0, len(entries))
+	for _, e := range sortedPasswd(entries) {
+		lines = append(lines, passwdLine(e))
+	}
+	return writeAtomic(filepath.Join(w.Directory, "passwd.cache"), lines)
+}
+
+// WriteGroup implements Writer.
+func (w *FilesWriter) WriteGroup(entries []*cache.GroupEntry) error {
+	lines := make([]string, 0, len(entries))
+	for _, e := range sortedGroup(entries) {
+		lines = append(lines, groupLine(e))
+	}
+	return writeAtomic(filepath.Join(w.Directory, "group.cache"), lines)
+}
+
+// WriteShadow implements Writer.
+func (w *FilesWriter) WriteShadow(entries []*cache.ShadowEntry) error {
+	lines := make([]string, 0, len(entries))
+	for _, e := range sortedShadow(entries) {
+		lines = append(lines, shadowLine(e))
+	}
+	return writeAtomic(filepath.Join(w.Directory, "shadow.cache"), lines)
+}
+
+// WriteNetgroup implements Writer.
+func (w *FilesWriter) WriteNetgroup(entries []*NetgroupEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, e.Line())
+	}
+	return writeAtomic(filepath.Join(w.Directory, "netgroup.cache"), lines)
+}
+
+// WriteAutomount implements Writer.  Every map, including the
+// synthesized auto.master, is written to its own
+// "automount.<map>.cache" file in Directory.
+func (w *FilesWriter) WriteAutomount(maps map[string][]*AutomountEntry) error {
+	for mapName, entries := range maps {
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			lines = append(lines, e.Line())
+		}
+		path := filepath.Join(w.Directory, fmt.Sprintf("automount.%s.cache", mapName))
+		if err := writeAtomic(path, lines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSudoers implements Writer.  Each entry is written to its own
+// /etc/sudoers.d/nsscache-<name> fragment and validated with `visudo
+// -c` before being renamed into place, so a typo in a group's
+// sudoers.* metadata can never break sudo on the host.  Any
+// nsscache-owned fragment left over from a previous run that no
+// longer corresponds to an entry is removed, so a group that drops
+// its sudoers.* metadata (or gets filtered out) has its grant revoked
+// instead of left in place indefinitely.
+func (w *FilesWriter) WriteSudoers(entries []*SudoersEntry) error {
+	dir := filepath.Join(w.Directory, "sudoers.d")
+	keep := make(map[string]bool, len(entries))
+
+	for _, e := range entries {
+		name := "nsscache-" + e.Name
+		keep[name] = true
+
+		path := filepath.Join(dir, name)
+		tmp := path + ".new"
+
+		if err := ioutil.WriteFile(tmp, []byte(e.Line()+"\n"), 0440); err != nil {
+			return err
+		}
+
+		if err := exec.Command("visudo", "-c", "-f", tmp).Run(); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("generated sudoers fragment for %q failed visudo validation: %w", e.Name, err)
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+
+	return pruneSudoersFragments(dir, keep)
+}
+
+// pruneSudoersFragments removes nsscache-<name> fragments found in dir
+// that aren't in keep.  Anything not matching the nsscache- prefix is
+// left alone, since it isn't ours to manage.
+func pruneSudoersFragments(dir string, keep map[string]bool) error {
+	existing, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range existing {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "nsscache-") || keep[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("removing stale sudoers fragment %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeAtomic writes lines, newline-terminated, to path via a
+// temporary file in the same directory followed by a rename.
+func writeAtomic(path string, lines []string) error {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+
+	tmp := path + ".new"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
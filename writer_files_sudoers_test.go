@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestPruneSudoersFragments verifies that a previously written
+// nsscache-owned fragment is removed once its entry disappears, while
+// fragments outside nsscache's ownership (or still current) are left
+// alone.
+func TestPruneSudoersFragments(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"nsscache-staff", "nsscache-ops", "local-admin-override"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("stub\n"), 0440); err != nil {
+			t.Fatalf("seeding %s: %v", name, err)
+		}
+	}
+
+	if err := pruneSudoersFragments(dir, map[string]bool{"nsscache-staff": true}); err != nil {
+		t.Fatalf("pruneSudoersFragments: %v", err)
+	}
+
+	assertExists(t, filepath.Join(dir, "nsscache-staff"), true)
+	assertExists(t, filepath.Join(dir, "local-admin-override"), true)
+	assertExists(t, filepath.Join(dir, "nsscache-ops"), false)
+}
+
+func assertExists(t *testing.T, path string, want bool) {
+	t.Helper()
+	_, err := ioutil.ReadFile(path)
+	got := err == nil
+	if got != want {
+		t.Fatalf("exists(%s) = %v, want %v (err: %v)", path, got, want, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// TestFilesWriterGolden pins the exact on-disk format WritePasswd,
+// WriteGroup and WriteShadow produce: sorted by UID/GID, duplicate
+// names dropped, newline-terminated.
+func TestFilesWriterGolden(t *testing.T) {
+	dir := t.TempDir()
+	w := &FilesWriter{Directory: dir}
+
+	passwd := []*cache.PasswdEntry{
+		{Name: "bob", Passwd: "*", UID: 2001, GID: 2000, Dir: "/home/bob", Shell: "/bin/bash"},
+		{Name: "alice", Passwd: "*", UID: 2000, GID: 2000, Dir: "/home/alice", Shell: "/bin/bash"},
+		{Name: "alice", Passwd: "*", UID: 9999, GID: 9999, Dir: "/dup", Shell: "/dup"},
+	}
+	if err := w.WritePasswd(passwd); err != nil {
+		t.Fatalf("WritePasswd: %v", err)
+	}
+	wantPasswd := "alice:*:2000:2000::/home/alice:/bin/bash\n" +
+		"bob:*:2001:2000::/home/bob:/bin/bash\n"
+	assertFileContent(t, filepath.Join(dir, "passwd.cache"), wantPasswd)
+
+	group := []*cache.GroupEntry{
+		{Name: "staff", Passwd: "*", GID: 2000, Mem: []string{"bob", "alice"}},
+		{Name: "admins", Passwd: "*", GID: 1999, Mem: nil},
+	}
+	if err := w.WriteGroup(group); err != nil {
+		t.Fatalf("WriteGroup: %v", err)
+	}
+	wantGroup := "admins:*:1999:\n" +
+		"staff:*:2000:bob,alice\n"
+	assertFileContent(t, filepath.Join(dir, "group.cache"), wantGroup)
+
+	shadow := []*cache.ShadowEntry{
+		{Name: "bob", Passwd: "*", LastChange: -1, Min: -1, Max: -1, Warn: -1, Inactive: -1, Expire: -1},
+		{Name: "alice", Passwd: "!", LastChange: 18000, Min: 0, Max: 90, Warn: 7, Inactive: 30, Expire: -1},
+	}
+	if err := w.WriteShadow(shadow); err != nil {
+		t.Fatalf("WriteShadow: %v", err)
+	}
+	wantShadow := "alice:!:18000:0:90:7:30::\n" +
+		"bob:*:::::::\n"
+	assertFileContent(t, filepath.Join(dir, "shadow.cache"), wantShadow)
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s content mismatch:\ngot:  %q\nwant: %q", path, got, want)
+	}
+}
@@ -0,0 +1,141 @@
+//go:build gdbm
+
+package main
+
+// #cgo LDFLAGS: -lgdbm
+// #include <gdbm.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// A GDBMWriter writes GDBM databases for sites still using nss_db's
+// GDBM backend instead of Berkeley DB, keyed the same way `makedb`
+// keys them: "." for the primary name lookup, "=" for the numeric id
+// lookup, and a plain decimal iteration cursor ("0", "1", "2", ...) in
+// insertion order so nss_db's getpwent/getgrent/getspent-style
+// sequential enumeration works, not just single-key lookups.
+// Building this writer requires libgdbm's headers and the `gdbm`
+// build tag (`go build -tags gdbm`).
+type GDBMWriter struct {
+	Directory string
+}
+
+func newGDBMWriter(dir string) (Writer, error) {
+	return &GDBMWriter{Directory: dir}, nil
+}
+
+// WritePasswd implements Writer.
+func (w *GDBMWriter) WritePasswd(entries []*cache.PasswdEntry) error {
+	sorted := sortedPasswd(entries)
+	pairs := make(map[string]string, len(sorted)*3)
+	for i, e := range sorted {
+		line := passwdLine(e)
+		pairs["."+e.Name] = line
+		pairs[fmt.Sprintf("=%d", e.UID)] = line
+		pairs[strconv.Itoa(i)] = line
+	}
+	return writeGDBM(filepath.Join(w.Directory, "passwd.gdbm"), pairs)
+}
+
+// WriteGroup implements Writer.
+func (w *GDBMWriter) WriteGroup(entries []*cache.GroupEntry) error {
+	sorted := sortedGroup(entries)
+	pairs := make(map[string]string, len(sorted)*3)
+	for i, e := range sorted {
+		line := groupLine(e)
+		pairs["."+e.Name] = line
+		pairs[fmt.Sprintf("=%d", e.GID)] = line
+		pairs[strconv.Itoa(i)] = line
+	}
+	return writeGDBM(filepath.Join(w.Directory, "group.gdbm"), pairs)
+}
+
+// WriteShadow implements Writer.
+func (w *GDBMWriter) WriteShadow(entries []*cache.ShadowEntry) error {
+	sorted := sortedShadow(entries)
+	pairs := make(map[string]string, len(sorted)*2)
+	for i, e := range sorted {
+		line := shadowLine(e)
+		pairs["."+e.Name] = line
+		pairs[strconv.Itoa(i)] = line
+	}
+	return writeGDBM(filepath.Join(w.Directory, "shadow.gdbm"), pairs)
+}
+
+// WriteNetgroup implements Writer.
+func (w *GDBMWriter) WriteNetgroup(entries []*NetgroupEntry) error {
+	pairs := make(map[string]string, len(entries))
+	for _, e := range entries {
+		pairs["."+e.Name] = e.Line()
+	}
+	return writeGDBM(filepath.Join(w.Directory, "netgroup.gdbm"), pairs)
+}
+
+// WriteAutomount implements Writer, with one database per map, keyed
+// by mount key.
+func (w *GDBMWriter) WriteAutomount(maps map[string][]*AutomountEntry) error {
+	for mapName, entries := range maps {
+		pairs := make(map[string]string, len(entries))
+		for _, e := range entries {
+			pairs["."+e.Key] = e.Value
+		}
+		if err := writeGDBM(filepath.Join(w.Directory, fmt.Sprintf("automount.%s.gdbm", mapName)), pairs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSudoers implements Writer.  There's no GDBM equivalent of
+// sudoers.d(5), so this format is rejected rather than silently
+// dropped.
+func (w *GDBMWriter) WriteSudoers(entries []*SudoersEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return fmt.Errorf("--format=gdbm has no sudoers representation, use --format=files or files+index")
+}
+
+// writeGDBM writes pairs into a new GDBM database at path, building
+// it under a temp name and renaming it into place.
+func writeGDBM(path string, pairs map[string]string) error {
+	tmp := path + ".new"
+
+	cTmp := C.CString(tmp)
+	defer C.free(unsafe.Pointer(cTmp))
+
+	dbf := C.gdbm_open(cTmp, 0, C.GDBM_NEWDB, 0644, nil)
+	if dbf == nil {
+		return fmt.Errorf("gdbm_open(%s): %s", tmp, C.GoString(C.gdbm_strerror(C.gdbm_errno)))
+	}
+	defer C.gdbm_close(dbf)
+
+	for k, v := range pairs {
+		// makedb's own output NUL-terminates both the key and the
+		// value, and nss_db's reader relies on that when it treats
+		// the returned value as a C string; match it here instead
+		// of storing bare, unterminated byte slices.
+		ck, cv := append([]byte(k), 0), append([]byte(v), 0)
+		key := C.datum{dptr: (*C.char)(unsafe.Pointer(&ck[0])), dsize: C.int(len(ck))}
+		data := C.datum{dptr: (*C.char)(unsafe.Pointer(&cv[0])), dsize: C.int(len(cv))}
+
+		if rc := C.gdbm_store(dbf, key, data, C.GDBM_REPLACE); rc != 0 {
+			err := fmt.Errorf("gdbm_store(%q): %s", k, C.GoString(C.gdbm_strerror(C.gdbm_errno)))
+			C.gdbm_close(dbf)
+			return err
+		}
+	}
+
+	// Close (and so flush) the database before renaming it into
+	// place, so a reader never opens a partially written file.
+	C.gdbm_close(dbf)
+	return renameOver(tmp, path)
+}
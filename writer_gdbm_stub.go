@@ -0,0 +1,12 @@
+//go:build !gdbm
+
+package main
+
+import "fmt"
+
+// newGDBMWriter reports that this binary wasn't built with GDBM
+// support.  Rebuild with `-tags gdbm` (and libgdbm's headers
+// installed) to enable --format=gdbm.
+func newGDBMWriter(dir string) (Writer, error) {
+	return nil, fmt.Errorf("--format=gdbm requires a binary built with -tags gdbm")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// indexKeySize, indexOffsetSize and indexRecordSize describe the
+// index record layout written by IndexWriter, matching what
+// libnss-cache's reader actually expects: indexKeySize bytes of
+// NUL-padded (or truncated) key, followed by an indexOffsetSize byte
+// ASCII-decimal byte offset into the corresponding flat file, followed
+// by a newline. Every record before its newline is the same length,
+// so the reader can binary search by seeking to an approximate byte
+// offset and scanning to the nearest '\n' to realign on a record
+// boundary, rather than trusting an arbitrary seek to land exactly on
+// one; the newline also makes the sidecar readable with ordinary line
+// tools. Because the offset is ASCII rather than binary, it can't
+// represent a byte offset past 99,999,999 (a ~95MB flat file) — a
+// real limitation of the format being matched here, not something
+// this writer can paper over without producing sidecars the real
+// reader can't parse.
+const (
+	indexKeySize    = 24
+	indexOffsetSize = 8
+	indexRecordSize = indexKeySize + indexOffsetSize + 1 // +1 for the newline
+)
+
+// idIndexKeyWidth is the zero-padded width used for the decimal
+// UID/GID keys in the .ixuid/.ixgid sidecars. Padding to a fixed
+// width makes the lexical sort writeIndexFile applies to all keys
+// equivalent to a numeric sort, which is what a binary search by
+// uid/gid actually needs; an unpadded "%d" would put "10" before "2".
+// uint32 tops out at 10 digits.
+const idIndexKeyWidth = 10
+
+// An IndexWriter writes the same flat files as FilesWriter, plus
+// name->offset and id->offset index sidecars for passwd and group (a
+// shadow index isn't useful since shadow is only ever read by UID via
+// the already-indexed passwd map).
+type IndexWriter struct {
+	FilesWriter
+}
+
+// WritePasswd implements Writer.
+func (w *IndexWriter) WritePasswd(entries []*cache.PasswdEntry) error {
+	sorted := sortedPasswd(entries)
+
+	byName := make(map[string]int64, len(sorted))
+	byUID := make(map[string]int64, len(sorted))
+	lines := make([]string, 0, len(sorted))
+
+	var offset int64
+	for _, e := range sorted {
+		line := passwdLine(e)
+		byName[e.Name] = offset
+		byUID[fmt.Sprintf("%0*d", idIndexKeyWidth, e.UID)] = offset
+		offset += int64(len(line)) + 1
+		lines = append(lines, line)
+	}
+
+	path := filepath.Join(w.Directory, "passwd.cache")
+	if err := writeAtomic(path, lines); err != nil {
+		return err
+	}
+	if err := writeIndexFile(path+".ixname", byName); err != nil {
+		return err
+	}
+	return writeIndexFile(path+".ixuid", byUID)
+}
+
+// WriteGroup implements Writer.
+func (w *IndexWriter) WriteGroup(entries []*cache.GroupEntry) error {
+	sorted := sortedGroup(entries)
+
+	byName := make(map[string]int64, len(sorted))
+	byGID := make(map[string]int64, len(sorted))
+	lines := make([]string, 0, len(sorted))
+
+	var offset int64
+	for _, e := range sorted {
+		line := groupLine(e)
+		byName[e.Name] = offset
+		byGID[fmt.Sprintf("%0*d", idIndexKeyWidth, e.GID)] = offset
+		offset += int64(len(line)) + 1
+		lines = append(lines, line)
+	}
+
+	path := filepath.Join(w.Directory, "group.cache")
+	if err := writeAtomic(path, lines); err != nil {
+		return err
+	}
+	if err := writeIndexFile(path+".ixname", byName); err != nil {
+		return err
+	}
+	return writeIndexFile(path+".ixgid", byGID)
+}
+
+// writeIndexFile writes index as a sorted, newline-delimited sequence
+// of fixed-width records to path, atomically.
+func writeIndexFile(path string, index map[string]int64) error {
+	keys := make([]string, 0, len(index))
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, len(keys)*indexRecordSize)
+	for _, k := range keys {
+		rec := make([]byte, indexRecordSize)
+		copy(rec, k) // remaining key bytes are left as NUL padding
+		copy(rec[indexKeySize:], []byte(fmt.Sprintf("%0*d", indexOffsetSize, index[k])))
+		rec[indexRecordSize-1] = '\n'
+		buf = append(buf, rec...)
+	}
+
+	tmp := path + ".new"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/MiLk/nsscache-go/cache"
+)
+
+// indexRecords splits a raw .ix* sidecar into its fixed-width,
+// newline-delimited records and decodes each one's key and offset.
+func indexRecords(t *testing.T, path string) (keys []string, offsets []uint64) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	if len(buf)%indexRecordSize != 0 {
+		t.Fatalf("%s is %d bytes, not a multiple of indexRecordSize %d", path, len(buf), indexRecordSize)
+	}
+	for i := 0; i < len(buf); i += indexRecordSize {
+		rec := buf[i : i+indexRecordSize]
+		if rec[indexRecordSize-1] != '\n' {
+			t.Fatalf("record %q is not newline-terminated", rec)
+		}
+
+		key := string(rec[:indexKeySize])
+		for j, b := range key {
+			if b == 0 {
+				key = key[:j]
+				break
+			}
+		}
+		keys = append(keys, key)
+
+		offsetField := string(rec[indexKeySize : indexRecordSize-1])
+		offset, err := strconv.ParseUint(offsetField, 10, 64)
+		if err != nil {
+			t.Fatalf("record %q has non-decimal offset field %q: %v", rec, offsetField, err)
+		}
+		offsets = append(offsets, offset)
+	}
+	return keys, offsets
+}
+
+// TestIndexWriterUIDSortIsNumeric guards against the id index sorting
+// its keys lexically ("10" < "2"): a binary search by UID needs the
+// on-disk record order to match numeric order.
+func TestIndexWriterUIDSortIsNumeric(t *testing.T) {
+	dir := t.TempDir()
+	w := &IndexWriter{FilesWriter: FilesWriter{Directory: dir}}
+
+	entries := []*cache.PasswdEntry{
+		{Name: "ten", Passwd: "*", UID: 10, GID: 10, Dir: "/h", Shell: "/bin/sh"},
+		{Name: "two", Passwd: "*", UID: 2, GID: 2, Dir: "/h", Shell: "/bin/sh"},
+		{Name: "hundred", Passwd: "*", UID: 100, GID: 100, Dir: "/h", Shell: "/bin/sh"},
+	}
+	if err := w.WritePasswd(entries); err != nil {
+		t.Fatalf("WritePasswd: %v", err)
+	}
+
+	keys, _ := indexRecords(t, filepath.Join(dir, "passwd.cache.ixuid"))
+	want := []string{"0000000002", "0000000010", "0000000100"}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d uid index records, want %d", len(keys), len(want))
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("uid index record %d = %q, want %q (records: %v)", i, keys[i], want[i], keys)
+		}
+	}
+}
+
+// TestIndexWriterOffsetRoundTrips pins the ASCII-decimal, 8-digit
+// offset field this sidecar format actually uses (matching
+// libnss-cache's reader), up to the largest offset that field can
+// represent without overflowing.
+func TestIndexWriterOffsetRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+
+	const maxOffset = int64(99999999) // largest value an 8-digit ASCII field holds
+	index := map[string]int64{"alice": maxOffset}
+	path := filepath.Join(dir, "big.cache.ixname")
+	if err := writeIndexFile(path, index); err != nil {
+		t.Fatalf("writeIndexFile: %v", err)
+	}
+
+	_, offsets := indexRecords(t, path)
+	if len(offsets) != 1 || offsets[0] != uint64(maxOffset) {
+		t.Fatalf("got offsets %v, want [%d]", offsets, maxOffset)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+// TestCacheFileNames pins the per-format file names handleMetrics
+// stats for the cache-file mtime gauge; getting these wrong leaves
+// the gauge silently empty under --format=bdb/gdbm.
+func TestCacheFileNames(t *testing.T) {
+	cases := map[string][]string{
+		"files":       {"passwd.cache", "group.cache", "shadow.cache"},
+		"files+index": {"passwd.cache", "group.cache", "shadow.cache"},
+		"bdb":         {"passwd.db", "group.db", "shadow.db"},
+		"gdbm":        {"passwd.gdbm", "group.gdbm", "shadow.gdbm"},
+	}
+
+	for format, want := range cases {
+		got := cacheFileNames(format)
+		if len(got) != len(want) {
+			t.Fatalf("cacheFileNames(%q) = %v, want %v", format, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("cacheFileNames(%q) = %v, want %v", format, got, want)
+			}
+		}
+	}
+}